@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUnquoteConfigValue(t *testing.T) {
+	cases := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: `plain`, want: `plain`},
+		{raw: `plain # a comment`, want: `plain`},
+		{raw: `"quoted with # and spaces"`, want: `quoted with # and spaces`},
+		{raw: `"unterminated`, wantErr: true},
+	}
+
+	for _, c := range cases {
+		got, err := unquoteConfigValue(c.raw)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("unquoteConfigValue(%q): expected error, got %q", c.raw, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("unquoteConfigValue(%q): unexpected error: %s", c.raw, err)
+		} else if got != c.want {
+			t.Errorf("unquoteConfigValue(%q) = %q, want %q", c.raw, got, c.want)
+		}
+	}
+}
+
+func TestSplitConfigLine(t *testing.T) {
+	key, value, err := splitConfigLine(`api_host = artifactory.example.com`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if key != "api_host" || value != "artifactory.example.com" {
+		t.Fatalf("got key=%q value=%q", key, value)
+	}
+
+	if _, _, err := splitConfigLine(`no equals sign`); err == nil {
+		t.Fatal("expected error for line with no '='")
+	}
+
+	if _, _, err := splitConfigLine(` = value`); err == nil {
+		t.Fatal("expected error for line with empty key")
+	}
+}
+
+func TestSetConfigField(t *testing.T) {
+	config := &JFrogConfig{}
+	v := reflect.ValueOf(config).Elem()
+
+	if err := setConfigField(v.FieldByName("ApiHost"), "artifactory.example.com"); err != nil {
+		t.Fatalf("unexpected error setting string field: %s", err)
+	}
+	if config.ApiHost != "artifactory.example.com" {
+		t.Fatalf("got ApiHost=%q", config.ApiHost)
+	}
+
+	if err := setConfigField(v.FieldByName("ApiTop"), "5"); err != nil {
+		t.Fatalf("unexpected error setting int field: %s", err)
+	}
+	if config.ApiTop != 5 {
+		t.Fatalf("got ApiTop=%d", config.ApiTop)
+	}
+
+	if err := setConfigField(v.FieldByName("ApiTop"), "not-a-number"); err == nil {
+		t.Fatal("expected error setting int field from non-numeric value")
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "jfrog-conf-*.conf")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	contents := "" +
+		"# comment\n" +
+		"api_host = artifactory.example.com\n" +
+		"\n" +
+		"[auth]\n" +
+		"api_top = 5\n"
+
+	if _, err := file.WriteString(contents); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	file.Close()
+
+	config := &JFrogConfig{ApiConf: file.Name(), cliSet: map[string]bool{}}
+	parseConfigFile(config)
+
+	if config.ApiHost != "artifactory.example.com" {
+		t.Errorf("got ApiHost=%q", config.ApiHost)
+	}
+	if config.ApiTop != 5 {
+		t.Errorf("got ApiTop=%d", config.ApiTop)
+	}
+}
@@ -3,23 +3,59 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"container/heap"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+/* Number of items requested per AQL page. */
+const aqlPageSize = 1000
+
+/* Default values for the top-N ranking flags. */
+const defaultTop = 2
+const defaultPattern = "*.jar"
+const defaultMetric = "downloads"
+
+/* Default auth mode: pick whichever credential was supplied. */
+const defaultAuth = "auto"
+
+/* Default output mode: human-readable text. */
+const defaultOutput = "text"
+
+/* Default re-scan interval for -serve daemon mode. */
+const defaultInterval = "5m"
+
+/*
+ *	apiTopCeiling is how many buckets the daemon retains per scan (or
+ *	-top, if that is larger), so a caller-supplied GET /top?n= can ask
+ *	for more than -top without forcing every scan to rank the whole
+ *	repository.
+ */
+const apiTopCeiling = 100
+
 type JFrogStats struct {
 	Downloads uint64 `json:"downloads"`
+	Downloaded uint64 `json:"downloaded"`
 }
 
 type JFrogItem struct {
 	Repo string `json:"repo"`
 	Path string `json:"path"`
 	Name string `json:"name"`
+	Size uint64 `json:"size"`
 	Stats []JFrogStats `json:"stats"`
 }
 
@@ -29,33 +65,82 @@ type JFrogRange struct {
 	Total uint64 `json:"total"`
 }
 
-type JFrogResult struct {
-	Items []JFrogItem `json:"results"`
-	Range JFrogRange `json:"range"`
+/*
+ *	TopBucket holds every item tied at a given metric value. Metric is
+ *	the ranking value (downloads, size, ...) shared by all Items.
+ */
+type TopBucket struct {
+	Metric uint64      `json:"metric"`
+	Items  []JFrogItem `json:"items"`
 }
 
 type JFrogTopResults struct {
-	Top1 JFrogResult `json:"top_one"`
-	Top2 JFrogResult `json:"top_two"`
+	Top          []TopBucket `json:"top"`
+	Truncated    bool        `json:"truncated,omitempty"`
+	ItemsScanned uint64      `json:"items_scanned,omitempty"`
+	ScanSeconds  float64     `json:"scan_seconds,omitempty"`
 }
 
 type JFrogConfig struct {
-	api_conf string
-	api_host string
-	api_key	 string
-    api_json string
+	ApiConf     string
+	ApiHost     string `conf:"api_host"`
+	ApiKey	     string `conf:"api_key"`
+	ApiOutput   string `conf:"api_output"`
+	ApiTop      int    `conf:"api_top"`
+	ApiPattern  string `conf:"api_pattern"`
+	ApiRepos    string `conf:"api_repos"`
+	ApiMetric   string `conf:"api_metric"`
+	ApiToken    string `conf:"api_token"`
+	ApiUser     string `conf:"api_user"`
+	ApiPassword string `conf:"api_password"`
+	ApiAuth     string `conf:"api_auth"`
+	ApiServe    string `conf:"api_serve"`
+	ApiInterval string `conf:"api_interval"`
+
+	/* Names of config keys the user set explicitly on the command
+	 * line; the config file must not override these. */
+	cliSet map[string]bool
+}
+
+/* Maps a command-line flag name to the JFrogConfig "conf" tag it
+ * corresponds to, so the config file parser can tell which values
+ * were already supplied on the command line. */
+var flagToConfTag = map[string]string{
+	"host":     "api_host",
+	"key":      "api_key",
+	"output":   "api_output",
+	"top":      "api_top",
+	"pattern":  "api_pattern",
+	"repos":    "api_repos",
+	"metric":   "api_metric",
+	"token":    "api_token",
+	"user":     "api_user",
+	"password": "api_password",
+	"auth":     "api_auth",
+	"serve":    "api_serve",
+	"interval": "api_interval",
 }
 
 
 func usage() {
 	fmt.Printf(
-		"Usage: %s [args] ...\n"           +
-		"Where arg is:\n"                  +
-		"    -conf=<configuration file>\n" +
-		"    -host=<hostname>\n"           +
-		"    -key=<API key>\n"             +
-		"    -json=<Yes|No>\n\n",
-		os.Args[0])
+		"Usage: %s [args] ...\n"                                     +
+		"Where arg is:\n"                                            +
+		"    -conf=<configuration file>\n"                           +
+		"    -host=<hostname>\n"                                     +
+		"    -key=<API key>\n"                                       +
+		"    -token=<bearer/identity token>\n"                       +
+		"    -user=<username>\n"                                     +
+		"    -password=<password>\n"                                 +
+		"    -auth=<bearer|basic|apikey|auto> (default %q)\n"        +
+		"    -output=<text|json|prom> (default %q)\n"               +
+		"    -top=<number of results> (default %d)\n"                +
+		"    -pattern=<glob, e.g. *.war> (default %q)\n"             +
+		"    -repos=<repoA,repoB,...>\n"                              +
+		"    -metric=<downloads|size|last_downloaded> (default %q)\n"  +
+		"    -serve=<addr> (run as a daemon serving /top and /follow)\n" +
+		"    -interval=<duration> (re-scan interval, default %q)\n\n",
+		os.Args[0], defaultAuth, defaultOutput, defaultTop, defaultPattern, defaultMetric, defaultInterval)
 }
 
 func parseCommandLine(config *JFrogConfig) {
@@ -63,10 +148,20 @@ func parseCommandLine(config *JFrogConfig) {
 		log.Fatal("parseCommandLine: ERROR: NULL pointer")
 	}
 
-	flag.StringVar(&config.api_conf, "conf", "", "Configuration File")
-	flag.StringVar(&config.api_host, "host", "", "Hostname")
-	flag.StringVar(&config.api_key, "key", "", "API Key")
-	flag.StringVar(&config.api_json, "json", "", "Export JSON")
+	flag.StringVar(&config.ApiConf, "conf", "", "Configuration File")
+	flag.StringVar(&config.ApiHost, "host", "", "Hostname")
+	flag.StringVar(&config.ApiKey, "key", "", "API Key")
+	flag.StringVar(&config.ApiToken, "token", "", "Bearer/identity token")
+	flag.StringVar(&config.ApiUser, "user", "", "Username")
+	flag.StringVar(&config.ApiPassword, "password", "", "Password")
+	flag.StringVar(&config.ApiAuth, "auth", defaultAuth, "Auth mode: bearer|basic|apikey|auto")
+	flag.StringVar(&config.ApiOutput, "output", defaultOutput, "Output mode: text|json|prom")
+	flag.IntVar(&config.ApiTop, "top", defaultTop, "Number of top results")
+	flag.StringVar(&config.ApiPattern, "pattern", defaultPattern, "File pattern (glob)")
+	flag.StringVar(&config.ApiRepos, "repos", "", "Comma-separated list of repositories")
+	flag.StringVar(&config.ApiMetric, "metric", defaultMetric, "Ranking metric: downloads|size|last_downloaded")
+	flag.StringVar(&config.ApiServe, "serve", "", "Run as a daemon serving /top and /follow on this address")
+	flag.StringVar(&config.ApiInterval, "interval", defaultInterval, "Re-scan interval in daemon mode")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -75,251 +170,911 @@ func parseCommandLine(config *JFrogConfig) {
 		usage()
 		os.Exit(1)
 	}
+
+	/* Remember which flags the user set explicitly, so the config
+	 * file parser knows not to override them. */
+	config.cliSet = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		if tag, ok := flagToConfTag[f.Name]; ok {
+			config.cliSet[tag] = true
+		}
+	})
+}
+
+/*
+ *	bindableConfigFields returns the set of JFrogConfig fields that the
+ *	config file is allowed to populate, keyed by their "conf" struct
+ *	tag. Adding a new option only means tagging the field - the parser
+ *	itself never needs to change.
+ */
+func bindableConfigFields(config *JFrogConfig) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("conf")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		fields[tag] = v.Field(i)
+	}
+
+	return fields
 }
 
 /*
- *	Read and parse jfrog configuration file. This function will parse
- *	out the API host and key from configuration file into the
- *	corresponding structure.
+ *	setConfigField assigns value to field, converting it to whatever
+ *	type the field actually is.
+ */
+func setConfigField(field reflect.Value, value string) error {
+	switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+
+		case reflect.Int:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid integer value %q", value)
+			}
+			field.SetInt(n)
+
+		default:
+			return fmt.Errorf("unsupported field kind %s", field.Kind())
+	}
+
+	return nil
+}
+
+/*
+ *	unquoteConfigValue strips a matching pair of surrounding double
+ *	quotes, leaving the contents - including '#' or whitespace -
+ *	untouched. Unquoted values may still carry a trailing "# comment".
+ */
+func unquoteConfigValue(raw string) (string, error) {
+	if raw == "" || raw[0] != '"' {
+		if idx := strings.Index(raw, "#"); idx >= 0 {
+			raw = strings.TrimSpace(raw[:idx])
+		}
+		return raw, nil
+	}
+
+	if len(raw) < 2 || raw[len(raw)-1] != '"' {
+		return "", fmt.Errorf("unterminated quoted value %s", raw)
+	}
+
+	return raw[1 : len(raw)-1], nil
+}
+
+/*
+ *	splitConfigLine splits a "key = value" line into its key and
+ *	(unquoted) value.
+ */
+func splitConfigLine(line string) (string, string, error) {
+	eq := strings.Index(line, "=")
+	if eq < 0 {
+		return "", "", fmt.Errorf("missing '=' in %q", line)
+	}
+
+	key := strings.ToLower(strings.TrimSpace(line[:eq]))
+	if key == "" {
+		return "", "", fmt.Errorf("missing key in %q", line)
+	}
+
+	value, err := unquoteConfigValue(strings.TrimSpace(line[eq+1:]))
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, value, nil
+}
+
+/*
+ *	Read and parse jfrog configuration file. Lines are "key = value"
+ *	pairs, optionally grouped under "[section]" headers purely for
+ *	namespacing duplicate-key detection - keys still bind to JFrogConfig
+ *	by their "conf" tag regardless of section. Values may be quoted to
+ *	preserve spaces or '#'. Command line arguments always take
+ *	precedence over the config file.
  */
 func parseConfigFile(config *JFrogConfig) {
 	if config == nil {
 		log.Fatal("parseConfigFile: ERROR: NULL config\n")
 
-	} else if config.api_conf == "" {
+	} else if config.ApiConf == "" {
 		log.Fatal("parseConfigFile: ERROR: No configuration specified\n")
 	}
 
-	file, err := os.Open(config.api_conf)
+	file, err := os.Open(config.ApiConf)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("parseConfigFile: ERROR: %s\n", err))
 	}
 
 	defer file.Close()
 
-	/* XXX: plen needs to match ptr array size */
-	plen := 3
-	ptr := [3]*string{0:&config.api_host,
-		1:&config.api_key, 2:&config.api_json}
-	set := false
-	idx := -1
+	fields := bindableConfigFields(config)
+	seen := make(map[string]bool)
+	section := ""
 
 	line_scanner := bufio.NewScanner(file)
 	line_scanner.Split(bufio.ScanLines)
+
+	lineno := 0
 	for line_scanner.Scan() {
-		line := line_scanner.Text()
+		lineno++
+
+		line := strings.TrimSpace(line_scanner.Text())
 		if line == "" || line[0] == '#' {
 			continue
 		}
 
-		words := strings.Fields(line)
-		for _, word := range words {
-			switch strings.ToLower(word) {
-				/*
-				 * If a value isn't set yet, we can set it. Otherwise,
-				 * let the command line argument override the value
-				 * specified in the configuration file.
-				 */
-				case "api_host":
-					if config.api_host == "" {
-						idx = 0
-					}
-				case "api_key":
-					if config.api_key == "" {
-						idx = 1
-					}
-				case "api_json":
-					idx = 2
-				case "=":
-					set = true
-				default:
-					if (idx > -1 && idx < plen) && set == true {
-						*ptr[idx] = word
-						set = false
-						idx = -1
-					}
-			}
+		if line[0] == '[' && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			continue
+		}
+
+		key, value, err := splitConfigLine(line)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("parseConfigFile: ERROR: line %d: %s\n", lineno, err))
+		}
+
+		path := key
+		if section != "" {
+			path = section + "." + key
+		}
+
+		if seen[path] {
+			log.Fatal(fmt.Sprintf("parseConfigFile: ERROR: line %d: duplicate key %q\n", lineno, path))
 		}
+		seen[path] = true
+
+		if config.cliSet[key] {
+			continue
+		}
+
+		field, ok := fields[key]
+		if !ok {
+			log.Fatal(fmt.Sprintf("parseConfigFile: ERROR: line %d: unknown key %q\n", lineno, path))
+		}
+
+		if err := setConfigField(field, value); err != nil {
+			log.Fatal(fmt.Sprintf("parseConfigFile: ERROR: line %d: %s\n", lineno, err))
+		}
+	}
+}
+
+/*
+ *	Given a JFrogItem, return its value for the selected ranking
+ *	metric. "downloads" and "last_downloaded" come from the item's
+ *	stat block; "size" is a property of the item itself.
+ */
+func getMetric(item JFrogItem, metric string) uint64 {
+	switch metric {
+		case "size":
+			return item.Size
+
+		case "last_downloaded":
+			if len(item.Stats) > 0 {
+				return item.Stats[0].Downloaded
+			}
+			return 0
+
+		default:
+			if len(item.Stats) > 0 {
+				return item.Stats[0].Downloads
+			}
+			return 0
 	}
 }
 
 /*
- *	Given an array of JFRogItem's, try to find the number of
- *	downloads greater than zero. The array passed to this 
- *	function will either have zero downloads, or identical 
- *	downloads for all elements.
+ *	topNHeap is a min-heap of TopBucket ordered by Metric, so the
+ *	bucket most eligible for eviction is always at the root.
  */
-func getDownloads(items []JFrogItem) uint64 {
-	for _, item := range items {
-		downloads := item.Stats[0].Downloads
-		if downloads > 0 {
-			return downloads
+type topNHeap []*TopBucket
+
+func (h topNHeap) Len() int            { return len(h) }
+func (h topNHeap) Less(i, j int) bool  { return h[i].Metric < h[j].Metric }
+func (h topNHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+
+func (h *topNHeap) Push(x interface{}) {
+	*h = append(*h, x.(*TopBucket))
+}
+
+func (h *topNHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	bucket := old[n-1]
+	*h = old[:n-1]
+	return bucket
+}
+
+/*
+ *	TopN tracks the N buckets with the highest metric value seen so
+ *	far, using a min-heap so evicting the lowest bucket is O(log N).
+ *	Each Add first scans all retained buckets for a tie, so an Add is
+ *	O(N) overall. Items tied with an existing bucket are appended to it, preserving
+ *	the "ties expand the bucket" semantics of the original top 2.
+ */
+type TopN struct {
+	n      int
+	metric string
+	heap   topNHeap
+}
+
+func NewTopN(n int, metric string) *TopN {
+	return &TopN{n: n, metric: metric}
+}
+
+func (t *TopN) Add(item JFrogItem) {
+	value := getMetric(item, t.metric)
+
+	for _, bucket := range t.heap {
+		if bucket.Metric == value {
+			bucket.Items = append(bucket.Items, item)
+			return
 		}
 	}
 
-	return 0
+	if len(t.heap) < t.n {
+		heap.Push(&t.heap, &TopBucket{Metric: value, Items: []JFrogItem{item}})
+		return
+	}
+
+	if len(t.heap) > 0 && value > t.heap[0].Metric {
+		heap.Pop(&t.heap)
+		heap.Push(&t.heap, &TopBucket{Metric: value, Items: []JFrogItem{item}})
+	}
 }
 
 /*
- *	Find the top 2 downloads. We keep track of items with identical
- *	downloads. So if an item has the same number of downloads as one of
- *	the top 2 items, it is appended to the corresponding list.
+ *	Sorted returns the tracked buckets ordered from highest to lowest
+ *	metric value.
  */
-func getTopDownloads(in <-chan *JFrogResult, out chan<- []JFrogItem) {
-	results := <-in
+func (t *TopN) Sorted() []TopBucket {
+	buckets := make([]*TopBucket, len(t.heap))
+	copy(buckets, t.heap)
 
-	top1 := []JFrogItem{JFrogItem{
-		Stats: []JFrogStats{JFrogStats{Downloads: 0},}}}
-	top2 := []JFrogItem{JFrogItem{
-		Stats: []JFrogStats{JFrogStats{Downloads: 0},}}}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Metric > buckets[j].Metric
+	})
 
-	for _, item := range results.Items {
-		downloads := item.Stats[0].Downloads
+	result := make([]TopBucket, len(buckets))
+	for i, bucket := range buckets {
+		result[i] = *bucket
+	}
 
-		top1_downloads := getDownloads(top1)
-		top2_downloads := getDownloads(top2)
+	return result
+}
 
-		if downloads > top1_downloads {
-			top1 = []JFrogItem{item}
+/*
+ *	Consume items one at a time from in, so the running top-N is
+ *	updated in O(N) per item (see TopN.Add) and peak memory does not grow with
+ *	repository size.
+ */
+func getTopN(in <-chan JFrogItem, out chan<- []TopBucket, n int, metric string) {
+	top := NewTopN(n, metric)
 
-		} else if downloads == top1_downloads {
-			top1 = append(top1, item)
+	for item := range in {
+		top.Add(item)
+	}
 
-		} else if downloads > top2_downloads &&
-			downloads != top1_downloads {
-			top2 = []JFrogItem{item}
+	out <- top.Sorted()
+}
+
+/*
+ *	Decode a single AQL response page from body, streaming each element
+ *	of the "results" array to out as it is parsed rather than buffering
+ *	the whole page in memory. Returns the page's JFrogRange so the
+ *	caller can decide whether to fetch another page.
+ */
+func decodeJFrogPage(body io.Reader, out chan<- JFrogItem) (JFrogRange, error) {
+	var rng JFrogRange
+
+	decoder := json.NewDecoder(body)
+
+	if _, err := decoder.Token(); err != nil {
+		return rng, err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return rng, err
+		}
 
-		} else if downloads == top2_downloads &&
-			downloads != top1_downloads {
-			top2 = append(top2, item)
+		key, ok := token.(string)
+		if !ok {
+			return rng, fmt.Errorf("decodeJFrogPage: ERROR: unexpected token %v", token)
+		}
+
+		switch key {
+			case "results":
+				if _, err := decoder.Token(); err != nil {
+					return rng, err
+				}
+
+				for decoder.More() {
+					var item JFrogItem
+					if err := decoder.Decode(&item); err != nil {
+						return rng, err
+					}
+
+					out <- item
+				}
+
+				if _, err := decoder.Token(); err != nil {
+					return rng, err
+				}
+
+			case "range":
+				if err := decoder.Decode(&rng); err != nil {
+					return rng, err
+				}
+
+			default:
+				var discard interface{}
+				if err := decoder.Decode(&discard); err != nil {
+					return rng, err
+				}
 		}
 	}
 
-	out <- top1
-	out <- top2
+	return rng, nil
 }
 
 /*
- *	Get array of JSON items from JFrog Artifactory server. We construct
- *	a query that will return all jar files with downloads greater than
- *	zero. The result will return the items name and number of downloads.
- *	Ideally, we would like to sort() the results on the server by number
- *	of downloads and limit the top 2 results, however, this does not
- *	work as expected for some reason. Therefore, we have to do the work
- *	ourselves.
+ *	jsonString renders s as a quoted, escaped JSON string literal so it
+ *	can be safely interpolated into a hand-built AQL query.
  */
-func getJFrogItems(out chan<- *JFrogResult, config *JFrogConfig) {
-	if config == nil {
-		log.Fatal("getJFrogItems: ERROR: NULL config")
+func jsonString(s string) string {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		/* json.Marshal of a string cannot fail. */
+		log.Fatal(fmt.Sprintf("jsonString: ERROR: %s", err))
+	}
+
+	return string(encoded)
+}
 
-	} else if config.api_host == "" || config.api_key == "" {
-		log.Fatal("getJFrogItems: ERROR: NULL host or api key")
+/*
+ *	Build the AQL payload for one page of results. The name pattern and
+ *	optional repo list come from config; offset/limit page through the
+ *	result set. Ideally, we would like to sort() the results on the
+ *	server by the ranking metric and limit to just the top N, however,
+ *	this does not work as expected for some reason. Therefore, we have
+ *	to do the work ourselves.
+ */
+func buildAQLQuery(config *JFrogConfig, offset uint64, limit uint64) string {
+	pattern := config.ApiPattern
+	if pattern == "" {
+		pattern = defaultPattern
 	}
 
-	api_fmt := "http://%s/artifactory/api/search/aql"
-	api_url := fmt.Sprintf(api_fmt, config.api_host)
+	criteria := fmt.Sprintf(`"name": { "$match" : %s }`, jsonString(pattern))
+
+	if config.ApiRepos != "" {
+		repos := strings.Split(config.ApiRepos, ",")
+		quoted := make([]string, len(repos))
+		for i, repo := range repos {
+			quoted[i] = jsonString(strings.TrimSpace(repo))
+		}
+		criteria += fmt.Sprintf(`, "repo": { "$in": [%s] }`, strings.Join(quoted, ", "))
+	}
 
-    payload := `items.find({
-			"name": { "$match" : "*.jar" },
+	return fmt.Sprintf(`items.find({
+			%s,
 			"$and": [
 				{ "stat.downloads": { "$gt": "0" } }
 			]
 		}).include(
-			"repo", "name", "path", "stat.downloads"
-	)`
+			"repo", "name", "path", "size", "stat.downloads", "stat.downloaded"
+	).offset(%d).limit(%d)`, criteria, offset, limit)
+}
 
-	req, err := http.NewRequest(http.MethodPost, api_url,
-		bytes.NewReader([]byte(payload)))
-	if err != nil {
-		log.Fatal(fmt.Sprintf("getJFrogItems: ERROR: %s", err))
+/*
+ *	The X-JFrog-Art-Api header is deprecated in newer Artifactory
+ *	releases in favor of bearer/identity tokens and HTTP Basic. auth
+ *	picks which credential to send: an explicit -auth mode, or
+ *	whichever credential was actually supplied when -auth=auto.
+ */
+func applyAuth(req *http.Request, config *JFrogConfig) error {
+	mode := config.ApiAuth
+	if mode == "" {
+		mode = defaultAuth
+	}
+
+	if mode == "auto" {
+		switch {
+			case config.ApiToken != "":
+				mode = "bearer"
+			case config.ApiUser != "" && config.ApiPassword != "":
+				mode = "basic"
+			case config.ApiKey != "":
+				mode = "apikey"
+			default:
+				return fmt.Errorf("applyAuth: ERROR: no credentials supplied (need -token, -user/-password, or -key)")
+		}
+	}
+
+	switch mode {
+		case "bearer":
+			if config.ApiToken == "" {
+				return fmt.Errorf("applyAuth: ERROR: -auth=bearer requires -token")
+			}
+			req.Header.Set("Authorization", "Bearer "+config.ApiToken)
+
+		case "basic":
+			if config.ApiUser == "" || config.ApiPassword == "" {
+				return fmt.Errorf("applyAuth: ERROR: -auth=basic requires -user and -password")
+			}
+			req.SetBasicAuth(config.ApiUser, config.ApiPassword)
+
+		case "apikey":
+			if config.ApiKey == "" {
+				return fmt.Errorf("applyAuth: ERROR: -auth=apikey requires -key")
+			}
+			/* Custom JFrog header for authentication using an API key */
+			req.Header.Set("X-JFrog-Art-Api", config.ApiKey)
+
+		default:
+			return fmt.Errorf("applyAuth: ERROR: unknown -auth mode %q", config.ApiAuth)
 	}
 
-	/* Custom JFrog header for authentication using an API key */
-	req.Header.Set("X-JFrog-Art-Api", config.api_key)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "text/plain")
+	return nil
+}
+
+/*
+ *	Get array of JSON items from JFrog Artifactory server, sending each
+ *	page's JFrogRange to rangeCh so the caller can report how many
+ *	items were scanned in total. Exactly one error (nil on success) is
+ *	sent to errCh once the scan finishes, so neither a transient network
+ *	hiccup nor a bad config forces a log.Fatal here - the caller decides
+ *	whether a failed scan is fatal (the CLI one-shot path) or merely
+ *	logged and retried next interval (the -serve daemon path).
+ *
+ *	Large repositories can return tens of thousands of items, so the
+ *	query is paginated with .offset()/.limit() and each page is streamed
+ *	into out as it arrives instead of being buffered whole.
+ */
+func getJFrogItems(out chan<- JFrogItem, rangeCh chan<- JFrogRange, errCh chan<- error, config *JFrogConfig) {
+	defer close(out)
+	defer close(rangeCh)
+
+	if config == nil {
+		errCh <- fmt.Errorf("getJFrogItems: ERROR: NULL config")
+		return
+
+	} else if config.ApiHost == "" {
+		errCh <- fmt.Errorf("getJFrogItems: ERROR: NULL host")
+		return
+
+	} else if config.ApiToken == "" && config.ApiKey == "" &&
+		!(config.ApiUser != "" && config.ApiPassword != "") {
+		errCh <- fmt.Errorf("getJFrogItems: ERROR: no credentials supplied " +
+			"(need -token, -user/-password, or -key)")
+		return
+	}
+
+	api_fmt := "http://%s/artifactory/api/search/aql"
+	api_url := fmt.Sprintf(api_fmt, config.ApiHost)
 
 	client := &http.Client{}
 
-	response, err := client.Do(req)
-	if err != nil {
-		log.Fatal(fmt.Sprintf("getJFrogItems: ERROR: %s\n", err))
+	var offset uint64 = 0
+	for {
+		payload := buildAQLQuery(config, offset, aqlPageSize)
+
+		req, err := http.NewRequest(http.MethodPost, api_url,
+			bytes.NewReader([]byte(payload)))
+		if err != nil {
+			errCh <- fmt.Errorf("getJFrogItems: ERROR: %s", err)
+			return
+		}
+
+		if err := applyAuth(req, config); err != nil {
+			errCh <- fmt.Errorf("getJFrogItems: ERROR: %s", err)
+			return
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Content-Type", "text/plain")
+
+		response, err := client.Do(req)
+		if err != nil {
+			errCh <- fmt.Errorf("getJFrogItems: ERROR: %s", err)
+			return
+		}
+
+		if response.StatusCode != 200 {
+			response.Body.Close()
+			errCh <- fmt.Errorf("getJFrogItems: ERROR: HTTP status %d is not 200", response.StatusCode)
+			return
+		}
+
+		rng, err := decodeJFrogPage(response.Body, out)
+		response.Body.Close()
+		if err != nil {
+			errCh <- fmt.Errorf("getJFrogItems: ERROR: %s", err)
+			return
+		}
+
+		rangeCh <- rng
+
+		if rng.End == 0 || rng.End >= rng.Total {
+			break
+		}
+
+		offset = rng.End
 	}
 
-	if response.StatusCode != 200 {
-		log.Fatal("getJFrogItems: ERROR: HTTP status is not 200\n")
+	errCh <- nil
+}
+
+/*
+ *	Scanner runs the getJFrogItems -> getTopN pipeline and caches the
+ *	latest result, so both the one-shot CLI path and the -serve daemon
+ *	can share the same scan logic. Run repeats the scan on config's
+ *	interval until ctx is cancelled; Snapshot returns the most recent
+ *	result without blocking on a new scan.
+ */
+type Scanner struct {
+	config *JFrogConfig
+
+	mu           sync.RWMutex
+	top          []TopBucket
+	retain       int
+	itemsScanned uint64
+	scanDuration time.Duration
+
+	subMu sync.Mutex
+	subs  map[chan JFrogItem]struct{}
+	last  map[string]uint64
+}
+
+func NewScanner(config *JFrogConfig) *Scanner {
+	return &Scanner{
+		config: config,
+		subs:   make(map[chan JFrogItem]struct{}),
+		last:   make(map[string]uint64),
 	}
+}
 
-	defer response.Body.Close()
+/*
+ *	scanKey identifies an item across scans for change detection.
+ */
+func scanKey(item JFrogItem) string {
+	return item.Repo + "/" + item.Path + "/" + item.Name
+}
 
-	var results = new(JFrogResult)
-	decoder := json.NewDecoder(response.Body)
-	err = decoder.Decode(&results)
-	if err != nil {
-		log.Fatal(fmt.Sprintf("getJFrogItems: ERROR: %s\n", err))
+/*
+ *	scanOnce runs the pipeline exactly once, retaining the top n buckets
+ *	and returning them along with how many items the AQL query matched
+ *	in total. err is non-nil if the scan failed partway through, in
+ *	which case the returned buckets should be discarded.
+ */
+func (s *Scanner) scanOnce(n int) ([]TopBucket, uint64, error) {
+	results_ch	:= make(chan JFrogItem)
+	items_ch	:= make(chan []TopBucket)
+	range_ch	:= make(chan JFrogRange)
+	err_ch		:= make(chan error, 1)
+
+	go getJFrogItems(results_ch, range_ch, err_ch, s.config)
+	go getTopN(results_ch, items_ch, n, s.config.ApiMetric)
+
+	var itemsScanned uint64
+	for rng := range range_ch {
+		itemsScanned = rng.Total
 	}
 
-	out <- results
+	top := <-items_ch
+	if err := <-err_ch; err != nil {
+		return nil, 0, err
+	}
+
+	return top, itemsScanned, nil
 }
 
-func showTopDownloadsJSON(top1 []JFrogItem, top2 []JFrogItem) {
-	top1_length := uint64(len(top1))
-	top2_length := uint64(len(top2))
+/*
+ *	publishChanges notifies /follow subscribers about any item whose
+ *	ranking metric differs from what the previous scan observed.
+ */
+func (s *Scanner) publishChanges(top []TopBucket) {
+	seen := make(map[string]bool)
 
-	top1_range := JFrogRange{Start:0, End:top1_length, Total:top1_length}
-	top2_range := JFrogRange{Start:0, End:top2_length, Total:top2_length}
+	for _, bucket := range top {
+		for _, item := range bucket.Items {
+			key := scanKey(item)
+			seen[key] = true
 
-	top1_result := JFrogResult{Items:top1, Range:top1_range}
-	top2_result := JFrogResult{Items:top2, Range:top2_range}
+			if prev, ok := s.last[key]; !ok || prev != bucket.Metric {
+				s.last[key] = bucket.Metric
+				s.publish(item)
+			}
+		}
+	}
 
-	top_results := JFrogTopResults{Top1:top1_result, Top2:top2_result}
-	top_json, err := json.MarshalIndent(top_results, "", "\t")
+	for key := range s.last {
+		if !seen[key] {
+			delete(s.last, key)
+		}
+	}
+}
+
+func (s *Scanner) publish(item JFrogItem) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+
+	for ch := range s.subs {
+		select {
+			case ch <- item:
+			default:
+				/* Drop the event rather than block a slow subscriber. */
+		}
+	}
+}
+
+/*
+ *	Subscribe returns a channel of items whose ranking metric just
+ *	changed. Callers must invoke the returned cancel function when
+ *	done to stop receiving events.
+ */
+func (s *Scanner) Subscribe() (<-chan JFrogItem, func()) {
+	ch := make(chan JFrogItem, 16)
+
+	s.subMu.Lock()
+	s.subs[ch] = struct{}{}
+	s.subMu.Unlock()
+
+	cancel := func() {
+		s.subMu.Lock()
+		delete(s.subs, ch)
+		close(ch)
+		s.subMu.Unlock()
+	}
+
+	return ch, cancel
+}
+
+/*
+ *	Snapshot returns the most recently completed scan's ranked buckets,
+ *	the bucket limit that scan ran with, and the scan's stats.
+ */
+func (s *Scanner) Snapshot() ([]TopBucket, int, uint64, time.Duration) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.top, s.retain, s.itemsScanned, s.scanDuration
+}
+
+/*
+ *	Run scans immediately, then repeats on config.ApiInterval until ctx
+ *	is cancelled.
+ */
+func (s *Scanner) Run(ctx context.Context) {
+	interval, err := time.ParseDuration(s.config.ApiInterval)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("showTopDownloadsJSON: ERROR: JSON Marshal"))
+		log.Fatal(fmt.Sprintf("Scanner.Run: ERROR: invalid -interval %q: %s", s.config.ApiInterval, err))
 	}
 
-	fmt.Printf("%s\n", top_json)
+	retain := s.config.ApiTop
+	if retain < apiTopCeiling {
+		retain = apiTopCeiling
+	}
+
+	for {
+		start := time.Now()
+		top, itemsScanned, err := s.scanOnce(retain)
+		duration := time.Since(start)
+
+		if err != nil {
+			log.Printf("Scanner.Run: ERROR: scan failed, keeping last snapshot: %s", err)
+
+		} else {
+			s.mu.Lock()
+			s.top = top
+			s.retain = retain
+			s.itemsScanned = itemsScanned
+			s.scanDuration = duration
+			s.mu.Unlock()
+
+			s.publishChanges(top)
+		}
+
+		select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+		}
+	}
 }
 
-func showTopDownloadsNormal(top1 []JFrogItem, top2 []JFrogItem) {
-	top1_downloads := getDownloads(top1)
-	top2_downloads := getDownloads(top2)
+/*
+ *	filterTopByPattern keeps only items whose name matches pattern,
+ *	dropping buckets that end up empty.
+ */
+func filterTopByPattern(top []TopBucket, pattern string) []TopBucket {
+	if pattern == "" {
+		return top
+	}
 
-	fmt.Printf("Top Downloads #1 [%d]:\n", top1_downloads)
-	fmt.Printf("-------------------------------\n")
-	for i, item := range top1 {
-		fmt.Printf("%2d. %s\n", i+1, item.Name)
+	filtered := make([]TopBucket, 0, len(top))
+	for _, bucket := range top {
+		items := make([]JFrogItem, 0, len(bucket.Items))
+		for _, item := range bucket.Items {
+			if ok, _ := filepath.Match(pattern, item.Name); ok {
+				items = append(items, item)
+			}
+		}
+
+		if len(items) > 0 {
+			filtered = append(filtered, TopBucket{Metric: bucket.Metric, Items: items})
+		}
 	}
 
-	fmt.Printf("\nTop Downloads #2 [%d]\n", top2_downloads)
-	fmt.Printf("-------------------------------\n")
-	for i, item := range top2 {
-		fmt.Printf("%2d. %s\n", i+1, item.Name)
+	return filtered
+}
+
+/*
+ *	handleTop serves GET /top?n=<count>&pattern=<glob>, returning the
+ *	latest scan's top-N buckets as JFrogTopResults JSON. n is honored up
+ *	to however many buckets the scan retained (see apiTopCeiling); a
+ *	request for more than that is clamped and reported via Truncated
+ *	rather than silently capped.
+ */
+func (s *Scanner) handleTop(w http.ResponseWriter, r *http.Request) {
+	snapshot, retain, itemsScanned, scanDuration := s.Snapshot()
+
+	n := s.config.ApiTop
+	if raw := r.URL.Query().Get("n"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			n = parsed
+		}
+	}
+
+	truncated := n > retain
+	if truncated {
+		n = retain
+	}
+
+	top := filterTopByPattern(snapshot, r.URL.Query().Get("pattern"))
+	if n < len(top) {
+		top = top[:n]
+	}
+
+	result := JFrogTopResults{
+		Top:          top,
+		Truncated:    truncated,
+		ItemsScanned: itemsScanned,
+		ScanSeconds:  scanDuration.Seconds(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("handleTop: ERROR: %s", err)
+	}
+}
+
+/*
+ *	handleFollow serves GET /follow, streaming newly-observed
+ *	download-count changes as server-sent events until the client
+ *	disconnects.
+ */
+func (s *Scanner) handleFollow(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, cancel := s.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+			case <-r.Context().Done():
+				return
+
+			case item, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				data, err := json.Marshal(item)
+				if err != nil {
+					continue
+				}
+
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+		}
 	}
 }
 
 /*
- *	Show the top 2 downloads. If there are multiple jar files with the
- *	same number of downloads, they are all displayed. 
+ *	serve runs config's Scanner as a daemon: it re-scans Artifactory on
+ *	config.ApiInterval and exposes the latest top-N results over HTTP.
  */
-func showTopTwoDownloads(in <-chan []JFrogItem, config *JFrogConfig) {
-	top1 := <-in
-	top2 := <-in
+func serve(config *JFrogConfig) {
+	scanner := NewScanner(config)
 
-	show_json := false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	if config.api_json != "" {
-		api_json := strings.ToLower(config.api_json)
-		if api_json == "true" || api_json == "yes" || api_json == "1" {
-			show_json = true
+	go scanner.Run(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/top", scanner.handleTop)
+	mux.HandleFunc("/follow", scanner.handleFollow)
+
+	log.Fatal(http.ListenAndServe(config.ApiServe, mux))
+}
+
+func showTopDownloadsJSON(top []TopBucket) {
+	top_results := JFrogTopResults{Top: top}
+	top_json, err := json.MarshalIndent(top_results, "", "\t")
+	if err != nil {
+		log.Fatal(fmt.Sprintf("showTopDownloadsJSON: ERROR: JSON Marshal"))
+	}
+
+	fmt.Printf("%s\n", top_json)
+}
+
+func showTopDownloadsNormal(top []TopBucket) {
+	for i, bucket := range top {
+		fmt.Printf("Top Downloads #%d [%d]:\n", i+1, bucket.Metric)
+		fmt.Printf("-------------------------------\n")
+		for j, item := range bucket.Items {
+			fmt.Printf("%2d. %s\n", j+1, item.Name)
 		}
+		fmt.Printf("\n")
 	}
+}
 
-	if show_json == true {
-		showTopDownloadsJSON(top1, top2)
+/*
+ *	Show the top N results as Prometheus text-format metrics, suitable
+ *	for a Prometheus textfile collector. Items tied on the ranking
+ *	metric share the same rank.
+ */
+func showTopDownloadsProm(top []TopBucket, duration time.Duration, itemsScanned uint64) {
+	fmt.Printf("# HELP jfrog_artifact_downloads Ranking metric value for a scanned artifact.\n")
+	fmt.Printf("# TYPE jfrog_artifact_downloads gauge\n")
+	for i, bucket := range top {
+		rank := i + 1
+		for _, item := range bucket.Items {
+			fmt.Printf("jfrog_artifact_downloads{repo=%q,path=%q,name=%q,rank=\"%d\"} %d\n",
+				item.Repo, item.Path, item.Name, rank, bucket.Metric)
+		}
+	}
+
+	fmt.Printf("# HELP jfrog_scrape_duration_seconds Time taken to scan Artifactory.\n")
+	fmt.Printf("# TYPE jfrog_scrape_duration_seconds gauge\n")
+	fmt.Printf("jfrog_scrape_duration_seconds %f\n", duration.Seconds())
+
+	fmt.Printf("# HELP jfrog_items_scanned_total Number of items matched by the AQL query.\n")
+	fmt.Printf("# TYPE jfrog_items_scanned_total counter\n")
+	fmt.Printf("jfrog_items_scanned_total %d\n", itemsScanned)
+}
+
+/*
+ *	Show the top N results. If there are multiple items tied on the
+ *	ranking metric, they are all displayed. duration and itemsScanned
+ *	are only used by the prom output mode.
+ */
+func showTopResults(top []TopBucket, config *JFrogConfig, duration time.Duration, itemsScanned uint64) {
+	switch config.ApiOutput {
+		case "json":
+			showTopDownloadsJSON(top)
 
-	} else {
-		showTopDownloadsNormal(top1, top2)
+		case "prom":
+			showTopDownloadsProm(top, duration, itemsScanned)
+
+		default:
+			showTopDownloadsNormal(top)
 	}
 }
 
@@ -330,18 +1085,37 @@ func main() {
 	parseCommandLine(&config)
 	parseConfigFile(&config)
 
-	results_ch	:= make(chan *JFrogResult)
-	items_ch	:= make(chan []JFrogItem)
+	switch config.ApiMetric {
+		case "downloads", "size", "last_downloaded":
+			/* valid */
+		default:
+			log.Fatal(fmt.Sprintf("main: ERROR: invalid -metric %q", config.ApiMetric))
+	}
 
-	defer close(results_ch)
-	defer close(items_ch)
+	switch config.ApiOutput {
+		case "text", "json", "prom":
+			/* valid */
+		default:
+			log.Fatal(fmt.Sprintf("main: ERROR: invalid -output %q", config.ApiOutput))
+	}
 
-	/* Get JSON items from JFrog artifactory server */
-	go getJFrogItems(results_ch, &config)
+	if config.ApiTop < 1 {
+		log.Fatal("main: ERROR: -top must be >= 1")
+	}
 
-	/* Parse out the top 2 downloads from the returned JSON */
-	go getTopDownloads(results_ch, items_ch)
+	if config.ApiServe != "" {
+		serve(&config)
+		return
+	}
+
+	scanner := NewScanner(&config)
+
+	start := time.Now()
+	top, itemsScanned, err := scanner.scanOnce(config.ApiTop)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("main: ERROR: %s", err))
+	}
 
-	/* Show the top 2 downloads */
-	showTopTwoDownloads(items_ch, &config)
+	/* Show the top N results */
+	showTopResults(top, &config, time.Since(start), itemsScanned)
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTopNAddEvictsLowestMetric(t *testing.T) {
+	top := NewTopN(2, "downloads")
+
+	top.Add(JFrogItem{Name: "a", Stats: []JFrogStats{{Downloads: 1}}})
+	top.Add(JFrogItem{Name: "b", Stats: []JFrogStats{{Downloads: 3}}})
+	top.Add(JFrogItem{Name: "c", Stats: []JFrogStats{{Downloads: 2}}})
+
+	sorted := top.Sorted()
+	if len(sorted) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(sorted))
+	}
+
+	if sorted[0].Metric != 3 || sorted[1].Metric != 2 {
+		t.Fatalf("expected metrics [3, 2], got [%d, %d]", sorted[0].Metric, sorted[1].Metric)
+	}
+}
+
+func TestTopNAddExpandsTiedBucket(t *testing.T) {
+	top := NewTopN(1, "downloads")
+
+	top.Add(JFrogItem{Name: "a", Stats: []JFrogStats{{Downloads: 5}}})
+	top.Add(JFrogItem{Name: "b", Stats: []JFrogStats{{Downloads: 5}}})
+
+	sorted := top.Sorted()
+	if len(sorted) != 1 {
+		t.Fatalf("expected 1 bucket, got %d", len(sorted))
+	}
+
+	if len(sorted[0].Items) != 2 {
+		t.Fatalf("expected tied items to share a bucket, got %d items", len(sorted[0].Items))
+	}
+}
+
+func TestTopNSortedOrdersHighestFirst(t *testing.T) {
+	top := NewTopN(3, "size")
+
+	top.Add(JFrogItem{Name: "a", Size: 10})
+	top.Add(JFrogItem{Name: "b", Size: 30})
+	top.Add(JFrogItem{Name: "c", Size: 20})
+
+	sorted := top.Sorted()
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].Metric < sorted[i].Metric {
+			t.Fatalf("Sorted() not descending: %+v", sorted)
+		}
+	}
+}
+
+func TestDecodeJFrogPageStreamsItemsAndRange(t *testing.T) {
+	body := strings.NewReader(`{
+		"results": [
+			{"repo": "r", "path": "p", "name": "a.jar", "size": 1, "stats": []},
+			{"repo": "r", "path": "p", "name": "b.jar", "size": 2, "stats": []}
+		],
+		"range": {"start_pos": 0, "end_pos": 2, "total": 2}
+	}`)
+
+	out := make(chan JFrogItem, 2)
+	rng, err := decodeJFrogPage(body, out)
+	close(out)
+
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if rng.Total != 2 {
+		t.Fatalf("expected range.total 2, got %d", rng.Total)
+	}
+
+	var names []string
+	for item := range out {
+		names = append(names, item.Name)
+	}
+
+	if len(names) != 2 || names[0] != "a.jar" || names[1] != "b.jar" {
+		t.Fatalf("expected [a.jar b.jar], got %v", names)
+	}
+}
+
+func TestDecodeJFrogPageInvalidJSON(t *testing.T) {
+	body := strings.NewReader(`not json`)
+
+	out := make(chan JFrogItem, 1)
+	_, err := decodeJFrogPage(body, out)
+	close(out)
+
+	if err == nil {
+		t.Fatal("expected error decoding malformed JSON")
+	}
+}